@@ -1,20 +1,35 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"debug/macho"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
+
+	"github.com/ulikunitz/xz"
 )
 
-// TODO: Make store/deflate toggleable? Store should be faster
-const zipMethod = zip.Store
 const defaultInterpreterLine = "/usr/bin/env python2.7"
 const zipInfoPath = "_zip_info_.json"
 
@@ -35,81 +50,915 @@ type manifest struct {
 	// TODO: Keep only one of these attributes?
 	ForceUnzip    []string `json:"force_unzip"`
 	ForceAllUnzip bool     `json:"force_all_unzip"`
+	// TestMode makes the resulting pyz a test binary: instead of dispatching to EntryPoint or
+	// ScriptPath, it discovers and runs unittest tests and (when TestOutputEnv is set in the
+	// environment) writes a JUnit XML report, for use by pyz_test.
+	TestMode      bool   `json:"test_mode"`
+	TestOutputEnv string `json:"test_output_env"`
+	// PreludePoints are module references, e.g. "mypkg.tracing_init" or "mypkg.monkeypatch:init",
+	// run in order before the main entry point dispatches. Useful for bootstrapping profilers,
+	// tracing, or logging config without editing every entry module.
+	PreludePoints []string `json:"prelude_points"`
+	// ConsoleScript, when set, resolves EntryPoint from the `[console_scripts]` section of a
+	// `*.dist-info/entry_points.txt` in one of Wheels, instead of requiring a hand-written
+	// module[:func] string. EntryPoint of the form "console_script:<name>" is equivalent.
+	ConsoleScript string `json:"console_script"`
+	// SourceArchives are packed like Wheels but are typically sdist tarballs rather than wheels;
+	// kept as a separate field so BUILD files can label intent. Both fields accept any format
+	// classifyArchive recognizes (.whl/.zip, .tar, .tar.gz/.tgz, .tar.bz2/.tbz2, .tar.xz/.txz).
+	SourceArchives []string `json:"source_archives"`
+	// Compression is the default zip storage method: "store" (default), "deflate", or
+	// "deflate-max". CompressionOverrides maps glob patterns (matched against either the full
+	// zip-relative path or its basename) to a Compression value, taking precedence over the
+	// default, e.g. {"*.so": "store"} to keep deflating .py/.json while storing native libs.
+	// "deflate-max" is only valid as the top-level Compression, not in CompressionOverrides.
+	Compression          string            `json:"compression"`
+	CompressionOverrides map[string]string `json:"compression_overrides"`
+	// Mtime, if non-zero, overrides SOURCE_DATE_EPOCH (seconds since the Unix epoch) for every
+	// zip entry. When either is set, entries are written in sorted order with normalized external
+	// attrs (0644 for regular files, 0755 for directories and paths matching Executable), making
+	// the output byte-identical across machines and clocks.
+	Mtime      int64    `json:"mtime"`
+	Executable []string `json:"executable"`
+	// PersistentUnzipCache, when true, extracts ForceUnzip/native-code paths into a directory
+	// keyed by the archive's content hash under UnzipCacheDir (or an XDG-style default) instead
+	// of a fresh temp dir per run, so repeated invocations of the same pyz skip re-extraction.
+	PersistentUnzipCache bool   `json:"persistent_unzip_cache"`
+	UnzipCacheDir        string `json:"unzip_cache_dir"`
+	// NativeResourceGlobs are glob patterns (matched like CompressionOverrides, against either the
+	// full zip-relative path or its basename) for non-library resource files that must be unzipped
+	// alongside a directory's native code, e.g. {"*.pem"} for gRPC's bundled root certificates.
+	// filterUnzipPaths only unzips a directory's own shared libraries automatically; anything else
+	// that code in that directory reads from disk has to be named here.
+	NativeResourceGlobs []string `json:"native_resource_globs"`
+}
+
+type preludePoint struct {
+	Module string
+	Func   string
 }
 
 type mainArgs struct {
 	ScriptPath  string
 	EntryPoint  string
 	Interpreter bool
+	// EntryPointModule/EntryPointFunc split EntryPoint on ":", the same module[:func] shape
+	// console_script resolution produces, so the template can call a function when one was given
+	// instead of always running the module as a script.
+	EntryPointModule string
+	EntryPointFunc   string
+	TestMode         bool
+	TestOutputEnv    string
+	PreludePoints    []preludePoint
 }
 
 type packageInfo struct {
 	UnzipPaths    []string `json:"unzip_paths"`
 	ForceAllUnzip bool     `json:"force_all_unzip"`
+	// ArchiveSHA256, PersistentUnzipCache and UnzipCacheDir are only populated when
+	// manifest.PersistentUnzipCache is set; they tell __main__.py where to extract to and let it
+	// skip extraction entirely once that directory is already populated.
+	ArchiveSHA256        string `json:"archive_sha256,omitempty"`
+	PersistentUnzipCache bool   `json:"persistent_unzip_cache,omitempty"`
+	UnzipCacheDir        string `json:"unzip_cache_dir,omitempty"`
 }
 
 func isPyFile(path string) bool {
 	return strings.HasSuffix(path, ".py") || strings.HasSuffix(path, ".pyc") || strings.HasSuffix(path, ".pyo")
 }
 
+var preludePointRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*(:[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Parses a prelude point reference of the form "pkg.mod" or "pkg.mod:func".
+func parsePreludePoint(ref string) (preludePoint, error) {
+	if !preludePointRe.MatchString(ref) {
+		return preludePoint{}, fmt.Errorf("invalid prelude point %#v: expected pkg.mod[:func]", ref)
+	}
+	parts := strings.SplitN(ref, ":", 2)
+	pp := preludePoint{Module: parts[0]}
+	if len(parts) == 2 {
+		pp.Func = parts[1]
+	}
+	return pp, nil
+}
+
+// compressionMethodFromString maps a manifest Compression value to a zip method constant.
+// "deflate" and "deflate-max" both map to zip.Deflate: the "-max" distinction is applied
+// separately, by registering a best-compression flate.Writer on the whole zip.Writer.
+func compressionMethodFromString(s string) (uint16, error) {
+	switch s {
+	case "", "store":
+		return zip.Store, nil
+	case "deflate", "deflate-max":
+		return zip.Deflate, nil
+	default:
+		return 0, fmt.Errorf("invalid Compression %#v: want \"store\", \"deflate\", or \"deflate-max\"", s)
+	}
+}
+
+// compressionOverrideMethodFromString is like compressionMethodFromString, but for a
+// CompressionOverrides entry rather than the top-level Compression field. "deflate-max" is
+// rejected here: best compression is applied by registering one flate.Writer for the whole
+// zip.Writer (see newCachedPathsZipWriter), so there's no way to honor it for only some entries
+// while other entries in the same archive use ordinary deflate.
+func compressionOverrideMethodFromString(s string) (uint16, error) {
+	if s == "deflate-max" {
+		return 0, fmt.Errorf(
+			"compression_overrides %#v: \"deflate-max\" is only supported as the top-level Compression, "+
+				"not per-glob; use \"deflate\" here and set Compression to \"deflate-max\" if you want every "+
+				"deflated entry at max compression", s)
+	}
+	return compressionMethodFromString(s)
+}
+
+// sortedStringMapKeys returns m's keys in sorted order, for deterministic iteration over
+// manifest-supplied maps like CompressionOverrides.
+func sortedStringMapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+const consoleScriptEntryPointPrefix = "console_script:"
+
+// parseEntryPointsINI parses the `[console_scripts]` section of a wheel's entry_points.txt
+// (standard INI format) into name -> "pkg.mod:func".
+func parseEntryPointsINI(r io.Reader) (map[string]string, error) {
+	scripts := map[string]string{}
+	inSection := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == "console_scripts"
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		scripts[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return scripts, scanner.Err()
+}
+
+// parseMetadataNameVersion pulls Name/Version out of a wheel's *.dist-info/METADATA headers.
+func parseMetadataNameVersion(r io.Reader) (name string, version string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break // end of the RFC 822-style header block
+		}
+		if strings.HasPrefix(line, "Name:") {
+			name = strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
+		} else if strings.HasPrefix(line, "Version:") {
+			version = strings.TrimSpace(strings.TrimPrefix(line, "Version:"))
+		}
+	}
+	return name, version
+}
+
+// countRecordEntries counts the file rows listed in a wheel's *.dist-info/RECORD.
+func countRecordEntries(r io.Reader) int {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// wheelConsoleScripts returns the console_scripts entry points declared by a single wheel.
+func wheelConsoleScripts(wheelPath string) (map[string]string, error) {
+	reader, err := zip.OpenReader(wheelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	for _, f := range reader.File {
+		if strings.HasSuffix(f.Name, ".dist-info/entry_points.txt") {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return parseEntryPointsINI(rc)
+		}
+	}
+	return map[string]string{}, nil
+}
+
+// resolveConsoleScript finds the module[:func] target for name across wheelPaths, erroring out
+// if no wheel defines it or more than one does.
+func resolveConsoleScript(name string, wheelPaths []string) (string, error) {
+	var definedBy []string
+	var target string
+	for _, wheelPath := range wheelPaths {
+		scripts, err := wheelConsoleScripts(wheelPath)
+		if err != nil {
+			return "", fmt.Errorf("error reading console_scripts from %s: %s", wheelPath, err)
+		}
+		if t, ok := scripts[name]; ok {
+			definedBy = append(definedBy, wheelPath)
+			target = t
+		}
+	}
+	if len(definedBy) == 0 {
+		return "", fmt.Errorf("console_script %#v not found in any of Wheels", name)
+	}
+	if len(definedBy) > 1 {
+		return "", fmt.Errorf("console_script %#v defined by multiple wheels: %s", name, strings.Join(definedBy, ", "))
+	}
+	return target, nil
+}
+
+// listConsoleScripts prints, for each wheel path given, its distribution name/version and every
+// console_scripts entry point it declares. Used by the --list-console-scripts debug mode.
+func listConsoleScripts(wheelPaths []string) {
+	for _, wheelPath := range wheelPaths {
+		reader, err := zip.OpenReader(wheelPath)
+		if err != nil {
+			panic(err)
+		}
+		var distName, distVersion string
+		recordCount := -1
+		scripts := map[string]string{}
+		for _, f := range reader.File {
+			switch {
+			case strings.HasSuffix(f.Name, ".dist-info/METADATA"):
+				rc, err := f.Open()
+				if err != nil {
+					panic(err)
+				}
+				distName, distVersion = parseMetadataNameVersion(rc)
+				rc.Close()
+			case strings.HasSuffix(f.Name, ".dist-info/RECORD"):
+				rc, err := f.Open()
+				if err != nil {
+					panic(err)
+				}
+				recordCount = countRecordEntries(rc)
+				rc.Close()
+			case strings.HasSuffix(f.Name, ".dist-info/entry_points.txt"):
+				rc, err := f.Open()
+				if err != nil {
+					panic(err)
+				}
+				scripts, err = parseEntryPointsINI(rc)
+				if err != nil {
+					panic(err)
+				}
+				rc.Close()
+			}
+		}
+		reader.Close()
+		fmt.Printf("%s (%s %s, %d files in RECORD):\n", wheelPath, distName, distVersion, recordCount)
+		names := make([]string, 0, len(scripts))
+		for name := range scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s = %s\n", name, scripts[name])
+		}
+	}
+}
+
+// defaultUnzipCacheDir mirrors __main__.py's fallback when manifest.UnzipCacheDir is empty:
+// $XDG_CACHE_HOME/pyz, or ~/.cache/pyz.
+func defaultUnzipCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "pyz")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Join(home, ".cache", "pyz")
+}
+
+// runPyzCacheGC removes PersistentUnzipCache entries under cacheDir that are older than
+// maxAgeDays: normally judged by the ".complete" sentinel's mtime (see the need_unzip template
+// code), or by the entry directory's own mtime when that sentinel is missing, i.e. a crashed or
+// killed extraction. Either way, an entry whose ".lock" is currently held by a live extraction is
+// left alone regardless of age.
+func runPyzCacheGC(cacheDir string, maxAgeDays int) {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		panic(err)
+	}
+	cutoff := time.Now().Add(-time.Duration(maxAgeDays) * 24 * time.Hour)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		entryPath := filepath.Join(cacheDir, entry.Name())
+		lockPath := entryPath + ".lock"
+		lastModified := entry.ModTime()
+		if info, err := os.Stat(filepath.Join(entryPath, ".complete")); err == nil {
+			lastModified = info.ModTime()
+		} else if !tryLock(lockPath) {
+			// a live extraction still holds this entry's lock: leave it alone regardless of age
+			continue
+		}
+		if lastModified.After(cutoff) {
+			continue
+		}
+		fmt.Printf("pyz-cache gc: removing %s (last modified %s)\n", entryPath, lastModified.Format(time.RFC3339))
+		if err := os.RemoveAll(entryPath); err != nil {
+			panic(err)
+		}
+		os.Remove(lockPath)
+	}
+}
+
+// tryLock reports whether lockPath's flock can be acquired without blocking, releasing it again
+// immediately if so. A missing lock file (nothing has ever raced to create tempdir) is reported
+// as unlocked, since nothing can be holding it.
+func tryLock(lockPath string) bool {
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return false
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true
+}
+
 // Takes e.g. "numpy-1.14.2.data/purelib/blah/stuff.py" and returns "blah/stuff.py". See
 // https://www.python.org/dev/peps/pep-0427/#what-s-the-deal-with-purelib-vs-platlib.
+// Also handles the analogous sdist "src/" layout, e.g. "src/blah/stuff.py" -> "blah/stuff.py".
+// A plain sdist "<pkg>/..." layout needs no rewriting once its name-version/ prefix is stripped.
 func handlePurelibPlatlib(path string) string {
 	newPath := path
 	newPath = purelibRe.ReplaceAllLiteralString(newPath, "")
 	newPath = platlibRe.ReplaceAllLiteralString(newPath, "")
+	newPath = strings.TrimPrefix(newPath, "src/")
 	return newPath
 }
 
-// Returns the list of paths that need to be unzipped.
-func filterUnzipPaths(paths []string) []string {
-	// find directories containing native code
-	nativeLibDirs := map[string]bool{}
-	for _, path := range paths {
-		// Versioned shared libs can have names like libffi-45372312.so.6.0.4
-		// Mac libs have both .so and .dylib
-		file := filepath.Base(path)
-		if strings.HasSuffix(file, ".so") || strings.Contains(file, ".so.") || strings.HasSuffix(file, ".dylib") {
-			nativeLibDirs[filepath.Dir(path)] = true
+// classifyArchive returns the archive format implied by path's extension, or "" if unrecognized.
+func classifyArchive(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".whl"), strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar.bz2"), strings.HasSuffix(lower, ".tbz2"):
+		return "tar.bz2"
+	case strings.HasSuffix(lower, ".tar.xz"), strings.HasSuffix(lower, ".txz"):
+		return "tar.xz"
+	default:
+		return ""
+	}
+}
+
+// sdistStem strips a tar-kind archive's compression suffix from its basename, e.g.
+// "mypkg-1.2.3.tar.gz" -> "mypkg-1.2.3", the "<name>-<version>" an sdist's wrapper directory is
+// expected to be named after.
+func sdistStem(archivePath string) string {
+	base := filepath.Base(archivePath)
+	lower := strings.ToLower(base)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar"} {
+		if strings.HasSuffix(lower, ext) {
+			return base[:len(base)-len(ext)]
 		}
 	}
+	return base
+}
 
-	// unzip all non-Python things in dirs containing native code, in case the code references it.
-	// E.g. gRPC needs to find certificates in a sub dir
-	output := []string{}
-	for _, path := range paths {
-		// Leave python files in the zip
-		if isPyFile(path) {
+// detectSdistTopLevelDir returns the shared "<name>-<version>/" prefix of names, or "" if the
+// entries don't all share one (e.g. a wheel, which has no such wrapper directory) or the shared
+// prefix doesn't match archivePath's own "<name>-<version>" stem (see sdistStem). That match is
+// required so that an arbitrary tarball which merely happens to have one top-level directory
+// (e.g. `tar czf pkg.tar.gz mypkg/`) isn't mistaken for an sdist and has its directory wrongly
+// stripped.
+func detectSdistTopLevelDir(names []string, archivePath string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	idx := strings.Index(names[0], "/")
+	if idx < 0 {
+		return ""
+	}
+	prefix := names[0][:idx+1]
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			return ""
+		}
+	}
+	if prefix != sdistStem(archivePath)+"/" {
+		return ""
+	}
+	return prefix
+}
+
+func tarDecompressor(kind string, r io.Reader) (io.Reader, error) {
+	switch kind {
+	case "tar":
+		return r, nil
+	case "tar.gz":
+		return gzip.NewReader(r)
+	case "tar.bz2":
+		return bzip2.NewReader(r), nil
+	case "tar.xz":
+		return xz.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unknown tar compression: %s", kind)
+	}
+}
+
+// processTarArchive copies the regular files of a tar-based archive (optionally gzip/bzip2/xz
+// compressed) into zipWriter, stripping an sdist's "<name>-<version>/" wrapper directory and
+// applying the same purelib/platlib/src rewriting as wheel members.
+func processTarArchive(path string, kind string, zipWriter *cachedPathsZipWriter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// first pass: collect names to find the sdist wrapper dir, and bail out clearly if this
+	// looks like unbuilt sdist sources (setup.py/pyproject.toml but no .py files to ship)
+	names := []string{}
+	hasBuildScaffold := false
+	hasPy := false
+	r, err := tarDecompressor(kind, f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		names = append(names, hdr.Name)
+		base := filepath.Base(hdr.Name)
+		if base == "setup.py" || base == "pyproject.toml" {
+			hasBuildScaffold = true
+			continue
+		}
+		if isPyFile(hdr.Name) {
+			hasPy = true
+		}
+	}
+	if hasBuildScaffold && !hasPy {
+		return fmt.Errorf(
+			"%s looks like an unbuilt sdist (has setup.py/pyproject.toml but no .py files): "+
+				"pre-build a wheel with `python -m build --wheel` and pass that instead", path)
+	}
+	topLevelDir := detectSdistTopLevelDir(names, path)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err = tarDecompressor(kind, f)
+	if err != nil {
+		return err
+	}
+	tr = tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
 			continue
 		}
+		pathWithinOutputZip := handlePurelibPlatlib(strings.TrimPrefix(hdr.Name, topLevelDir))
+		writer, err := zipWriter.CreateWithMethod(hdr.FileInfo(), pathWithinOutputZip)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		for nativeLibDir := range nativeLibDirs {
-			if strings.HasPrefix(path, nativeLibDir+"/") || (nativeLibDir == "." && !strings.ContainsRune(path, '/')) {
+// processZipArchive copies the members of a wheel or plain zip archive into zipWriter, applying
+// the purelib/platlib rewriting wheels use for their *.data/ directories.
+func processZipArchive(path string, zipWriter *cachedPathsZipWriter) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("Error loading %s: %s", path, err)
+	}
+	defer reader.Close()
+	for _, wheelF := range reader.File {
+		pathWithinOutputZip := handlePurelibPlatlib(wheelF.Name)
+		wheelFReader, err := wheelF.Open()
+		if err != nil {
+			return err
+		}
+		copyF, err := zipWriter.CreateWithMethod(wheelF.FileInfo(), pathWithinOutputZip)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(copyF, wheelFReader); err != nil {
+			return err
+		}
+		if err := wheelFReader.Close(); err != nil {
+			return err
+		}
+	}
+	return reader.Close()
+}
+
+// isNativeLibraryPath reports whether path's basename looks like a shared library: ELF .so
+// (optionally multiply-versioned, e.g. "libffi-45372312.so.6.0.4") or Mach-O .dylib.
+func isNativeLibraryPath(path string) bool {
+	file := filepath.Base(path)
+	return strings.HasSuffix(file, ".so") || strings.Contains(file, ".so.") || strings.HasSuffix(file, ".dylib")
+}
+
+// elfDependencies reads an already-opened ELF shared library's DT_NEEDED sonames and its
+// DT_RUNPATH/DT_RPATH search directories, resolving a leading "$ORIGIN"/"${ORIGIN}" token (as the
+// dynamic linker does) relative to dir, the library's own zip-relative directory.
+func elfDependencies(f *elf.File, dir string) (needed []string, searchDirs []string, err error) {
+	needed, err = f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		// DynString returns an error when tag is absent; that just means this library has none.
+		paths, tagErr := f.DynString(tag)
+		if tagErr != nil {
+			continue
+		}
+		for _, path := range paths {
+			for _, entry := range strings.Split(path, ":") {
+				entry = strings.Replace(entry, "$ORIGIN", dir, -1)
+				entry = strings.Replace(entry, "${ORIGIN}", dir, -1)
+				searchDirs = append(searchDirs, filepath.Clean(entry))
+			}
+		}
+	}
+	return needed, searchDirs, nil
+}
+
+// machoDependencies reads an already-opened Mach-O shared library's LC_LOAD_DYLIB install names
+// and LC_RPATH search directories, resolving a leading "@loader_path"/"@executable_path" token
+// relative to dir, the library's own zip-relative directory. "@rpath"-prefixed install names are
+// left as-is: they are matched against other libraries by basename regardless of prefix.
+func machoDependencies(f *macho.File, dir string) (needed []string, searchDirs []string, err error) {
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, nil, err
+	}
+	needed = append(needed, libs...)
+	for _, load := range f.Loads {
+		rpath, ok := load.(*macho.Rpath)
+		if !ok {
+			continue
+		}
+		path := strings.Replace(rpath.Path, "@loader_path", dir, -1)
+		path = strings.Replace(path, "@executable_path", dir, -1)
+		searchDirs = append(searchDirs, filepath.Clean(path))
+	}
+	return needed, searchDirs, nil
+}
+
+// resolveNeeded looks up a NEEDED soname by basename in byBasenameAndDir (see
+// scanNativeDependencies), restricted to reachableDirs: the needing library's own directory plus
+// its resolved RPATH/RUNPATH/LC_RPATH entries. Returns every matching path (normally at most one,
+// since byBasenameAndDir keys by directory too, but reachableDirs itself can list more than one
+// directory); nil if name isn't reachable from any of them.
+func resolveNeeded(name string, reachableDirs []string, byBasenameAndDir map[string]map[string]string) []string {
+	base := filepath.Base(name)
+	var matches []string
+	for _, dir := range reachableDirs {
+		if candidate, ok := byBasenameAndDir[base][dir]; ok {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+// scanNativeDependencies parses every captured shared library in nativeLibData for its NEEDED
+// dependencies (see elfDependencies/machoDependencies) and follows them to build the transitive
+// closure of native libraries this archive's code can actually reach. A NEEDED soname is matched
+// by basename against only the candidates the dynamic linker would actually consider reachable
+// from that specific library: its own directory (the common layout for a wheel's bundled libs,
+// even without an explicit "$ORIGIN" rpath entry) and its own resolved RPATH/RUNPATH/LC_RPATH
+// directories — never the whole archive, so that two wheels bundling same-named-but-different
+// libraries (e.g. two copies of libopenblas.so in different packages) don't get cross-matched.
+// We still don't model the dynamic linker's full system search order (LD_LIBRARY_PATH, ldconfig
+// cache, etc.), since those resolve to the host's libraries rather than anything bundled here.
+// Returns the closure (always including every path in nativeLibData) plus the set of
+// RPATH/RUNPATH/LC_RPATH directories any of them declared.
+func scanNativeDependencies(allPaths []string, nativeLibData map[string][]byte) (closure map[string]bool, searchDirs map[string]bool) {
+	byBasenameAndDir := map[string]map[string]string{}
+	for _, path := range allPaths {
+		base := filepath.Base(path)
+		dir := filepath.Dir(path)
+		if byBasenameAndDir[base] == nil {
+			byBasenameAndDir[base] = map[string]string{}
+		}
+		byBasenameAndDir[base][dir] = path
+	}
+
+	closure = map[string]bool{}
+	searchDirs = map[string]bool{}
+	queue := make([]string, 0, len(nativeLibData))
+	for path := range nativeLibData {
+		closure[path] = true
+		queue = append(queue, path)
+	}
+	// deterministic traversal order: doesn't change the result, but keeps it reproducible to debug
+	sort.Strings(queue)
+
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		data := nativeLibData[path]
+		dir := filepath.Dir(path)
+
+		var needed, libSearchDirs []string
+		var err error
+		if elfFile, elfErr := elf.NewFile(bytes.NewReader(data)); elfErr == nil {
+			needed, libSearchDirs, err = elfDependencies(elfFile, dir)
+			elfFile.Close()
+		} else if machoFile, machoErr := macho.NewFile(bytes.NewReader(data)); machoErr == nil {
+			needed, libSearchDirs, err = machoDependencies(machoFile, dir)
+			machoFile.Close()
+		} else {
+			// not an ELF/Mach-O file we can parse (a static archive named *.so, a fat/universal
+			// Mach-O binary, a stripped or corrupt file, ...): keep it in the closure (it was
+			// already captured because of its name) but can't walk its dependencies.
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, searchDir := range libSearchDirs {
+			searchDirs[searchDir] = true
+		}
+		reachableDirs := append([]string{dir}, libSearchDirs...)
+		for _, name := range needed {
+			candidates := resolveNeeded(name, reachableDirs, byBasenameAndDir)
+			for _, candidate := range candidates {
+				if !closure[candidate] {
+					closure[candidate] = true
+					queue = append(queue, candidate)
+				}
+			}
+			if len(candidates) == 0 && !isLikelySystemLibrary(filepath.Base(name)) {
+				fmt.Fprintf(os.Stderr, "Warning: %s needs %s, which is not a system library or a bundled file reachable from its directory or rpath\n", path, name)
+			}
+		}
+	}
+	return closure, searchDirs
+}
+
+// isLikelySystemLibrary reports whether base names a shared library we expect to be resolved by
+// the dynamic linker from the host system rather than bundled in the archive, e.g. libc.so.6 or
+// libpthread.so.0. This is a heuristic used only to decide whether an unresolved NEEDED entry is
+// worth a warning; it is not consulted when building the unzip closure.
+func isLikelySystemLibrary(base string) bool {
+	systemLibPrefixes := []string{
+		"libc.so", "libm.so", "libdl.so", "libpthread.so", "librt.so", "libresolv.so", "libutil.so",
+		"libstdc++.so", "libgcc_s.so", "ld-linux", "libSystem.B.dylib",
+	}
+	for _, prefix := range systemLibPrefixes {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterUnzipPaths returns the paths that need to be unzipped: the transitive closure of native
+// library dependencies found by scanNativeDependencies (so the dynamic linker can find them on
+// disk), plus, for any directory that closure touches, whatever else matches resourceGlobs (e.g.
+// gRPC's bundled root certificates) since a dependency walk can't discover plain data files.
+func filterUnzipPaths(allPaths []string, nativeLibData map[string][]byte, resourceGlobs []string) []string {
+	closure, searchDirs := scanNativeDependencies(allPaths, nativeLibData)
+
+	nativeLibDirs := map[string]bool{}
+	for path := range closure {
+		nativeLibDirs[filepath.Dir(path)] = true
+	}
+	for dir := range searchDirs {
+		nativeLibDirs[dir] = true
+	}
+
+	output := []string{}
+	for path := range closure {
+		output = append(output, path)
+	}
+	for _, path := range allPaths {
+		if closure[path] || isPyFile(path) {
+			continue
+		}
+		if !nativeLibDirs[filepath.Dir(path)] {
+			continue
+		}
+		matched := false
+		for _, glob := range resourceGlobs {
+			if globMatchesPath(glob, path) {
 				output = append(output, path)
+				matched = true
 				break
 			}
 		}
+		if !matched {
+			// This directory has native code whose closure we extract, but this particular
+			// non-Python file isn't named in NativeResourceGlobs, so it stays zipped. That's fine
+			// for files the native code never reads off disk, but silently wrong for something
+			// like gRPC's bundled root certs: warn so the gap is visible at pack time instead of
+			// as a runtime FileNotFoundError.
+			fmt.Fprintf(os.Stderr, "Warning: %s is in a native-code directory but matches no native_resource_globs; it will stay zipped\n", path)
+		}
 	}
+	sort.Strings(output)
 	return output
 }
 
+type compressionRule struct {
+	Glob   string
+	Method uint16
+}
+
+type compressionConfig struct {
+	Default   uint16
+	Overrides []compressionRule
+}
+
+// globMatchesPath reports whether glob matches name, tried both against the full zip-relative
+// path and against just its basename (so "*.so" matches at any depth).
+func globMatchesPath(glob string, name string) bool {
+	if ok, _ := filepath.Match(glob, name); ok {
+		return true
+	}
+	ok, _ := filepath.Match(glob, filepath.Base(name))
+	return ok
+}
+
+func (c compressionConfig) resolve(name string) uint16 {
+	for _, rule := range c.Overrides {
+		if globMatchesPath(rule.Glob, name) {
+			return rule.Method
+		}
+	}
+	return c.Default
+}
+
+// pendingZipEntry buffers one entry's content in memory so reproducible mode can flush all
+// entries in sorted order once every CreateWithMethod call has been made.
+type pendingZipEntry struct {
+	name       string
+	method     uint16
+	isDir      bool
+	executable bool
+	data       *bytes.Buffer
+}
+
 type cachedPathsZipWriter struct {
-	writer zip.Writer
-	paths  map[string]bool
+	writer      zip.Writer
+	paths       map[string]bool
+	compression compressionConfig
+	// reproducible, when true, buffers entries (see pending) instead of streaming them straight
+	// to writer, so that Close can flush them in sorted order with a forced Modified timestamp
+	// and normalized external attrs, for byte-identical output across machines and clocks.
+	reproducible    bool
+	mtime           time.Time
+	executableGlobs []string
+	pending         []*pendingZipEntry
+	// contentHash accumulates the name and content of every entry written so far, letting
+	// ContentHash identify this archive's content for PersistentUnzipCache once all entries
+	// (other than _zip_info_.json itself) have been added.
+	contentHash hash.Hash
+	// nativeLibData holds a copy of every entry written so far whose name looks like a shared
+	// library (see isNativeLibraryPath), for scanNativeDependencies to parse once all entries are
+	// in.
+	nativeLibData map[string]*bytes.Buffer
 }
 
-func newCachedPathsZipWriter(w io.Writer) *cachedPathsZipWriter {
+func newCachedPathsZipWriter(
+	w io.Writer, compression compressionConfig, bestCompression bool, reproducible bool, mtime time.Time,
+	executableGlobs []string,
+) *cachedPathsZipWriter {
 	zw := zip.NewWriter(w)
-	return &cachedPathsZipWriter{*zw, make(map[string]bool)}
+	c := &cachedPathsZipWriter{
+		writer:          *zw,
+		paths:           make(map[string]bool),
+		compression:     compression,
+		reproducible:    reproducible,
+		mtime:           mtime,
+		executableGlobs: executableGlobs,
+		contentHash:     sha256.New(),
+		nativeLibData:   make(map[string]*bytes.Buffer),
+	}
+	if bestCompression {
+		// applies to every entry written with the Deflate method, including those selected by a
+		// per-glob override; Store-overridden entries are unaffected.
+		c.writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, flate.BestCompression)
+		})
+	}
+	return c
+}
+
+func (c *cachedPathsZipWriter) isExecutable(name string) bool {
+	for _, glob := range c.executableGlobs {
+		if globMatchesPath(glob, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // Same as zip.Writer: Does not close the underlying writer.
 func (c *cachedPathsZipWriter) Close() error {
+	if c.reproducible {
+		sort.Slice(c.pending, func(i, j int) bool { return c.pending[i].name < c.pending[j].name })
+		for _, entry := range c.pending {
+			header := &zip.FileHeader{Name: entry.name, Method: entry.method}
+			header.Modified = c.mtime
+			switch {
+			case entry.isDir:
+				header.SetMode(os.ModeDir | 0755)
+			case entry.executable:
+				header.SetMode(0755)
+			default:
+				header.SetMode(0644)
+			}
+			out, err := c.writer.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if _, err := out.Write(entry.data.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
 	return c.writer.Close()
 }
-func (c *cachedPathsZipWriter) CreateWithMethod(
-	fileinfo os.FileInfo, name string, method uint16,
-) (io.Writer, error) {
+
+// CreateWithMethod adds a new entry named name to the zip, picking its compression method from
+// the writer's compressionConfig (no caller-supplied method: Compression/CompressionOverrides
+// decide that now).
+func (c *cachedPathsZipWriter) CreateWithMethod(fileinfo os.FileInfo, name string) (io.Writer, error) {
+	method := c.compression.resolve(name)
+	c.paths[name] = true
+	// name is written as a delimiter so e.g. an empty "a" followed by "b" can't hash the same as
+	// "ab" followed by an empty entry.
+	io.WriteString(c.contentHash, name+"\x00")
+
+	var capture *bytes.Buffer
+	if isNativeLibraryPath(name) {
+		capture = &bytes.Buffer{}
+		c.nativeLibData[name] = capture
+	}
+
+	if c.reproducible {
+		entry := &pendingZipEntry{
+			name:       name,
+			method:     method,
+			isDir:      strings.HasSuffix(name, "/") || (fileinfo != nil && fileinfo.IsDir()),
+			executable: c.isExecutable(name),
+			data:       &bytes.Buffer{},
+		}
+		c.pending = append(c.pending, entry)
+		writers := []io.Writer{entry.data, c.contentHash}
+		if capture != nil {
+			writers = append(writers, capture)
+		}
+		return io.MultiWriter(writers...), nil
+	}
+
 	var header *zip.FileHeader
 	var err error
 	if fileinfo != nil {
@@ -126,9 +975,30 @@ func (c *cachedPathsZipWriter) CreateWithMethod(
 	if err != nil {
 		return nil, err
 	}
-	// only append the path if we got "success"
-	c.paths[name] = true
-	return out, nil
+	writers := []io.Writer{out, c.contentHash}
+	if capture != nil {
+		writers = append(writers, capture)
+	}
+	return io.MultiWriter(writers...), nil
+}
+
+// NativeLibraryData returns the content of every entry written so far whose name looks like a
+// shared library (see isNativeLibraryPath). Only valid to call once every such entry has been
+// fully written, since it does not copy: the returned slices alias the live capture buffers.
+func (c *cachedPathsZipWriter) NativeLibraryData() map[string][]byte {
+	out := make(map[string][]byte, len(c.nativeLibData))
+	for name, buf := range c.nativeLibData {
+		out[name] = buf.Bytes()
+	}
+	return out
+}
+
+// ContentHash returns the hex-encoded SHA256 of every entry name and its content written so far,
+// in the order CreateWithMethod was called (not necessarily the final on-disk order in
+// reproducible mode). Intended to be read once, after every real entry has been added and before
+// the final _zip_info_.json entry that embeds it.
+func (c *cachedPathsZipWriter) ContentHash() string {
+	return hex.EncodeToString(c.contentHash.Sum(nil))
 }
 
 // Returns the paths written to this zip so far.
@@ -147,8 +1017,30 @@ func (c *cachedPathsZipWriter) Contains(path string) bool {
 }
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "--list-console-scripts" {
+		listConsoleScripts(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 3 && os.Args[1] == "pyz-cache" && os.Args[2] == "gc" {
+		cacheDir := defaultUnzipCacheDir()
+		maxAgeDays := 30
+		if len(os.Args) >= 4 {
+			cacheDir = os.Args[3]
+		}
+		if len(os.Args) >= 5 {
+			n, err := strconv.Atoi(os.Args[4])
+			if err != nil {
+				panic(err)
+			}
+			maxAgeDays = n
+		}
+		runPyzCacheGC(cacheDir, maxAgeDays)
+		return
+	}
 	if len(os.Args) != 3 {
 		fmt.Fprintln(os.Stderr, "Usage: simplepack (manifest.json) (output_executable)")
+		fmt.Fprintln(os.Stderr, "       simplepack --list-console-scripts (wheel.whl)...")
+		fmt.Fprintln(os.Stderr, "       simplepack pyz-cache gc [cache_dir] [max_age_days]")
 		os.Exit(1)
 	}
 	manifestPath := os.Args[1]
@@ -170,9 +1062,9 @@ func main() {
 		panic(err)
 	}
 
-	if len(zipManifest.Sources) == 0 && zipManifest.EntryPoint == "" && !zipManifest.Interpreter {
+	if len(zipManifest.Sources) == 0 && zipManifest.EntryPoint == "" && zipManifest.ConsoleScript == "" && !zipManifest.Interpreter {
 		fmt.Fprintln(os.Stderr,
-			"Error: one of Sources or EntryPoint cannot be empty or Interpreter must be true")
+			"Error: one of Sources, EntryPoint or ConsoleScript cannot be empty or Interpreter must be true")
 		os.Exit(1)
 	}
 	if zipManifest.EntryPoint != "" && zipManifest.Interpreter {
@@ -180,6 +1072,79 @@ func main() {
 			"Error: only one of EntryPoint OR Interpreter can be set")
 		os.Exit(1)
 	}
+	if zipManifest.ConsoleScript != "" && (zipManifest.EntryPoint != "" || zipManifest.Interpreter) {
+		fmt.Fprintln(os.Stderr,
+			"Error: ConsoleScript cannot be combined with EntryPoint or Interpreter")
+		os.Exit(1)
+	}
+	if zipManifest.TestMode && zipManifest.Interpreter {
+		fmt.Fprintln(os.Stderr,
+			"Error: TestMode and Interpreter cannot both be set")
+		os.Exit(1)
+	}
+	if zipManifest.TestMode && zipManifest.ConsoleScript != "" {
+		fmt.Fprintln(os.Stderr,
+			"Error: TestMode and ConsoleScript cannot both be set")
+		os.Exit(1)
+	}
+	if zipManifest.TestMode && strings.Contains(zipManifest.EntryPoint, ":") {
+		fmt.Fprintln(os.Stderr,
+			"Error: TestMode's EntryPoint must be a dotted test module name (e.g. \"mypkg.tests\"), "+
+				"not a module:func console-script-style target")
+		os.Exit(1)
+	}
+	if zipManifest.TestMode && zipManifest.EntryPoint == "" {
+		// Guessing the test module from Sources[0] would depend on a BUILD file's srcs ordering,
+		// which isn't a promise callers make; require it explicitly instead.
+		fmt.Fprintln(os.Stderr,
+			"Error: TestMode requires EntryPoint to name the test module to run (e.g. \"mypkg.tests\")")
+		os.Exit(1)
+	}
+	if zipManifest.TestMode && zipManifest.TestOutputEnv == "" {
+		zipManifest.TestOutputEnv = "XML_OUTPUT_FILE"
+	}
+
+	if zipManifest.ConsoleScript != "" {
+		target, err := resolveConsoleScript(zipManifest.ConsoleScript, zipManifest.Wheels)
+		if err != nil {
+			panic(err)
+		}
+		zipManifest.EntryPoint = target
+	} else if strings.HasPrefix(zipManifest.EntryPoint, consoleScriptEntryPointPrefix) {
+		name := strings.TrimPrefix(zipManifest.EntryPoint, consoleScriptEntryPointPrefix)
+		target, err := resolveConsoleScript(name, zipManifest.Wheels)
+		if err != nil {
+			panic(err)
+		}
+		zipManifest.EntryPoint = target
+	}
+
+	defaultMethod, err := compressionMethodFromString(zipManifest.Compression)
+	if err != nil {
+		panic(err)
+	}
+	var overrides []compressionRule
+	for _, glob := range sortedStringMapKeys(zipManifest.CompressionOverrides) {
+		method, err := compressionOverrideMethodFromString(zipManifest.CompressionOverrides[glob])
+		if err != nil {
+			panic(err)
+		}
+		overrides = append(overrides, compressionRule{Glob: glob, Method: method})
+	}
+
+	var mtime time.Time
+	reproducible := false
+	if zipManifest.Mtime != 0 {
+		mtime = time.Unix(zipManifest.Mtime, 0).UTC()
+		reproducible = true
+	} else if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			panic(fmt.Errorf("invalid SOURCE_DATE_EPOCH %#v: %s", epoch, err))
+		}
+		mtime = time.Unix(seconds, 0).UTC()
+		reproducible = true
+	}
 
 	outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err != nil {
@@ -195,7 +1160,14 @@ func main() {
 	outFile.Write([]byte("#!"))
 	outFile.Write([]byte(zipManifest.InterpreterPath))
 	outFile.Write([]byte("\n"))
-	zipWriter := newCachedPathsZipWriter(outFile)
+	zipWriter := newCachedPathsZipWriter(
+		outFile,
+		compressionConfig{Default: defaultMethod, Overrides: overrides},
+		zipManifest.Compression == "deflate-max",
+		reproducible,
+		mtime,
+		zipManifest.Executable,
+	)
 	defer zipWriter.Close()
 
 	for _, sourceMeta := range zipManifest.Sources {
@@ -214,7 +1186,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		writer, err := zipWriter.CreateWithMethod(stat, sourceMeta.Dst, zipMethod)
+		writer, err := zipWriter.CreateWithMethod(stat, sourceMeta.Dst)
 		if err != nil {
 			panic(err)
 		}
@@ -228,56 +1200,56 @@ func main() {
 		}
 	}
 
-	writer, err := zipWriter.CreateWithMethod(nil, "__main__.py", zipMethod)
+	writer, err := zipWriter.CreateWithMethod(nil, "__main__.py")
 	if err != nil {
 		panic(err)
 	}
+	preludePoints := make([]preludePoint, 0, len(zipManifest.PreludePoints))
+	for _, ref := range zipManifest.PreludePoints {
+		pp, err := parsePreludePoint(ref)
+		if err != nil {
+			panic(err)
+		}
+		preludePoints = append(preludePoints, pp)
+	}
+
 	args := &mainArgs{
-		EntryPoint:  zipManifest.EntryPoint,
-		Interpreter: zipManifest.Interpreter,
+		EntryPoint:    zipManifest.EntryPoint,
+		Interpreter:   zipManifest.Interpreter,
+		TestMode:      zipManifest.TestMode,
+		TestOutputEnv: zipManifest.TestOutputEnv,
+		PreludePoints: preludePoints,
 	}
-	if zipManifest.EntryPoint == "" && !zipManifest.Interpreter {
+	if !zipManifest.TestMode && zipManifest.EntryPoint == "" && !zipManifest.Interpreter {
 		args.ScriptPath = zipManifest.Sources[0].Dst
 	}
+	if args.EntryPoint != "" && !zipManifest.TestMode {
+		args.EntryPointModule = args.EntryPoint
+		if idx := strings.Index(args.EntryPoint, ":"); idx >= 0 {
+			args.EntryPointModule = args.EntryPoint[:idx]
+			args.EntryPointFunc = args.EntryPoint[idx+1:]
+		}
+	}
 	err = mainTemplate.Execute(writer, args)
 	if err != nil {
 		panic(err)
 	}
 
-	// copy the wheels
-	for _, wheelPath := range zipManifest.Wheels {
-		reader, err := zip.OpenReader(wheelPath)
-		if err != nil {
-			panic(fmt.Errorf("Error loading %s: %s", wheelPath, err))
-		}
-		for _, wheelF := range reader.File {
-			// Handle code stored in <package>-<version>.data/purelib or platlib. See
-			// https://www.python.org/dev/peps/pep-0427/#what-s-the-deal-with-purelib-vs-platlib.
-			pathWithinOutputZip := handlePurelibPlatlib(wheelF.Name)
-			// if wheelF.Name != pathWithinOutputZip {
-			// 	  fmt.Fprintln(os.Stderr, "  pathWithinOutputZip, orig: ", wheelF.Name)
-			// 	  fmt.Fprintln(os.Stderr, "  pathWithinOutputZip, repl: ", pathWithinOutputZip)
-			// }
-			wheelFReader, err := wheelF.Open()
-			if err != nil {
-				panic(err)
-			}
-			copyF, err := zipWriter.CreateWithMethod(wheelF.FileInfo(), pathWithinOutputZip, zipMethod)
-			if err != nil {
-				panic(err)
-			}
-			_, err = io.Copy(copyF, wheelFReader)
-			if err != nil {
+	// copy the wheels and any source archives, dispatching by extension
+	archivePaths := append(append([]string{}, zipManifest.Wheels...), zipManifest.SourceArchives...)
+	for _, archivePath := range archivePaths {
+		kind := classifyArchive(archivePath)
+		switch kind {
+		case "zip":
+			if err := processZipArchive(archivePath, zipWriter); err != nil {
 				panic(err)
 			}
-			err = wheelFReader.Close()
-			if err != nil {
+		case "tar", "tar.gz", "tar.bz2", "tar.xz":
+			if err := processTarArchive(archivePath, kind, zipWriter); err != nil {
 				panic(err)
 			}
-		}
-		err = reader.Close()
-		if err != nil {
-			panic(err)
+		default:
+			panic(fmt.Errorf("unsupported archive format: %s", archivePath))
 		}
 	}
 
@@ -307,7 +1279,7 @@ func main() {
 	for _, initPyPath := range createInitPyPaths {
 		// TODO: Add a verbose log flag? This could be useful for debugging problems
 		// fmt.Printf("warning: creating %s\n", initPyPath)
-		_, err := zipWriter.CreateWithMethod(nil, initPyPath, zipMethod)
+		_, err := zipWriter.CreateWithMethod(nil, initPyPath)
 		if err != nil {
 			panic(err)
 		}
@@ -341,13 +1313,18 @@ func main() {
 		// don't list paths if we are going to unzip all
 		unzipPaths = []string{}
 	} else {
-		nativeCodeUnzipPaths := filterUnzipPaths(zipWriter.Paths())
+		nativeCodeUnzipPaths := filterUnzipPaths(zipWriter.Paths(), zipWriter.NativeLibraryData(), zipManifest.NativeResourceGlobs)
 		unzipPaths = append(unzipPaths, nativeCodeUnzipPaths...)
 	}
 
 	// write the zip package metadata for the __main__ script to use
-	zipPackageMetadata := &packageInfo{unzipPaths, zipManifest.ForceAllUnzip}
-	writer, err = zipWriter.CreateWithMethod(nil, zipInfoPath, zipMethod)
+	zipPackageMetadata := &packageInfo{UnzipPaths: unzipPaths, ForceAllUnzip: zipManifest.ForceAllUnzip}
+	if zipManifest.PersistentUnzipCache {
+		zipPackageMetadata.ArchiveSHA256 = zipWriter.ContentHash()
+		zipPackageMetadata.PersistentUnzipCache = true
+		zipPackageMetadata.UnzipCacheDir = zipManifest.UnzipCacheDir
+	}
+	writer, err = zipWriter.CreateWithMethod(nil, zipInfoPath)
 	if err != nil {
 		panic(err)
 	}
@@ -477,10 +1454,7 @@ tempdir_create_pid = None
 need_unzip = len(package_info['unzip_paths']) > 0 or package_info['force_all_unzip']
 if need_unzip and isinstance(__loader__, zipimport.zipimporter):
     # do not import these modules unless we have to
-    import atexit
     import shutil
-    import signal
-    import tempfile
     import types
     import zipfile
 
@@ -496,20 +1470,52 @@ if need_unzip and isinstance(__loader__, zipimport.zipimporter):
                 os.chmod(extracted_path, original_attr)
             return extracted_path
 
-    # create the dir and clean it up atexit:
-    # can't use a finally handler: it gets invoked BEFORE tracebacks are printed
-    tempdir = tempfile.mkdtemp('_pyzip')
-    tempdir_create_pid = os.getpid()
-    atexit.register(clean_tempdir_parent_only, tempdir)
-    sys.path.insert(0, tempdir)
-    # Handle linux signal terminate by calling exit, so atexit code executes.
-    old_handler = None
-    def sig_exit(*args):
-        if sys.path[0].endswith('_pyzip'):
-            shutil.rmtree(sys.path[0])
-        if old_handler:
-            old_handler(*args)
-    old_handler = signal.signal(signal.SIGTERM, sig_exit)
+    use_persistent_cache = bool(package_info.get('persistent_unzip_cache'))
+    lock_file = None
+    need_extract = True
+    complete_marker = None
+    if use_persistent_cache:
+        # Extract once into a directory keyed by archive content, instead of a fresh tempdir per
+        # run: an .flock-guarded .complete sentinel lets later runs (and other processes) skip
+        # extraction entirely, and skips the atexit/SIGTERM cleanup below since the dir is meant
+        # to outlive this process.
+        import errno
+        import fcntl
+        cache_dir = package_info.get('unzip_cache_dir') or ''
+        if not cache_dir:
+            cache_dir = os.environ.get('XDG_CACHE_HOME') or os.path.join(os.path.expanduser('~'), '.cache')
+            cache_dir = os.path.join(cache_dir, 'pyz')
+        tempdir = os.path.join(cache_dir, package_info['archive_sha256'])
+        tempdir_create_pid = os.getpid()
+        try:
+            os.makedirs(tempdir)
+        except OSError as e:
+            if e.errno != errno.EEXIST:
+                raise
+        lock_file = open(tempdir + '.lock', 'a')
+        fcntl.flock(lock_file.fileno(), fcntl.LOCK_EX)
+        complete_marker = os.path.join(tempdir, '.complete')
+        need_extract = not os.path.exists(complete_marker)
+        sys.path.insert(0, tempdir)
+    else:
+        import atexit
+        import signal
+        import tempfile
+
+        # create the dir and clean it up atexit:
+        # can't use a finally handler: it gets invoked BEFORE tracebacks are printed
+        tempdir = tempfile.mkdtemp('_pyzip')
+        tempdir_create_pid = os.getpid()
+        atexit.register(clean_tempdir_parent_only, tempdir)
+        sys.path.insert(0, tempdir)
+        # Handle linux signal terminate by calling exit, so atexit code executes.
+        old_handler = None
+        def sig_exit(*args):
+            if sys.path[0].endswith('_pyzip'):
+                shutil.rmtree(sys.path[0])
+            if old_handler:
+                old_handler(*args)
+        old_handler = signal.signal(signal.SIGTERM, sig_exit)
 
     package_zip = PreservePermissionsZipFile(__loader__.archive)
     files_to_unzip = package_info['unzip_paths']
@@ -524,7 +1530,13 @@ if need_unzip and isinstance(__loader__, zipimport.zipimporter):
             pkg_resources.EGG_DIST = pkg_resources.DEVELOP_DIST-1
         except ImportError:
             pass
-    package_zip.extractall(path=tempdir, members=files_to_unzip)
+    if need_extract:
+        package_zip.extractall(path=tempdir, members=files_to_unzip)
+        if use_persistent_cache:
+            open(complete_marker, 'a').close()
+    if use_persistent_cache:
+        fcntl.flock(lock_file.fileno(), fcntl.LOCK_UN)
+        lock_file.close()
 
     # pkgutil.extend_path does not add zips to __path__; hack a function that will
     # register it as a module so it can be referenced from random __init__.py
@@ -563,7 +1575,115 @@ if need_unzip and isinstance(__loader__, zipimport.zipimporter):
                 _copy_as_namespace(tempdir, unzipped_dir)
             unzipped_dir = os.path.dirname(unzipped_dir)
 
-{{if or .ScriptPath .Interpreter }}
+{{range .PreludePoints}}
+{{if .Func}}
+import importlib as _importlib
+getattr(_importlib.import_module('{{.Module}}'), '{{.Func}}')()
+{{else}}
+import runpy as _runpy
+_runpy.run_module('{{.Module}}', run_name='__main__')
+{{end}}
+{{end}}
+{{if .TestMode }}
+import time as _time
+import traceback as _traceback
+import unittest
+import xml.sax.saxutils as _saxutils
+
+
+class _JUnitTestResult(unittest.TestResult):
+    '''Collects per-test name, duration, status, output and traceback for a JUnit report.'''
+
+    def __init__(self, *args, **kwargs):
+        unittest.TestResult.__init__(self, *args, **kwargs)
+        self.test_cases = []
+        self._start_times = {}
+
+    def startTest(self, test):
+        unittest.TestResult.startTest(self, test)
+        self._start_times[test] = _time.time()
+
+    def _record(self, test, status, trace=None):
+        duration = _time.time() - self._start_times.get(test, _time.time())
+        stdout = self._stdout_buffer.getvalue() if self.buffer else ''
+        stderr = self._stderr_buffer.getvalue() if self.buffer else ''
+        self.test_cases.append({
+            'classname': test.__class__.__module__ + '.' + test.__class__.__name__,
+            'name': test._testMethodName,
+            'time': duration,
+            'status': status,
+            'stdout': stdout,
+            'stderr': stderr,
+            'trace': trace,
+        })
+
+    def addSuccess(self, test):
+        unittest.TestResult.addSuccess(self, test)
+        self._record(test, 'pass')
+
+    def addFailure(self, test, err):
+        unittest.TestResult.addFailure(self, test, err)
+        self._record(test, 'fail', ''.join(_traceback.format_exception(*err)))
+
+    def addError(self, test, err):
+        unittest.TestResult.addError(self, test, err)
+        self._record(test, 'error', ''.join(_traceback.format_exception(*err)))
+
+    def addSkip(self, test, reason):
+        unittest.TestResult.addSkip(self, test, reason)
+        self._record(test, 'skip', reason)
+
+
+def _write_junit_xml(path, suite_name, test_cases, total_time):
+    failures = sum(1 for c in test_cases if c['status'] == 'fail')
+    errors = sum(1 for c in test_cases if c['status'] == 'error')
+    skipped = sum(1 for c in test_cases if c['status'] == 'skip')
+
+    lines = ['<?xml version="1.0" encoding="UTF-8"?>', '<testsuites>']
+    lines.append(
+        '  <testsuite name=%s tests="%d" failures="%d" errors="%d" skipped="%d" time="%.3f">' % (
+            _saxutils.quoteattr(suite_name), len(test_cases), failures, errors, skipped, total_time))
+    for case in test_cases:
+        lines.append('    <testcase classname=%s name=%s time="%.3f">' % (
+            _saxutils.quoteattr(case['classname']), _saxutils.quoteattr(case['name']), case['time']))
+        if case['status'] == 'fail':
+            lines.append('      <failure message="test failure">%s</failure>' % _saxutils.escape(case['trace'] or ''))
+        elif case['status'] == 'error':
+            lines.append('      <error message="test error">%s</error>' % _saxutils.escape(case['trace'] or ''))
+        elif case['status'] == 'skip':
+            lines.append('      <skipped message=%s></skipped>' % _saxutils.quoteattr(case['trace'] or ''))
+        if case['stdout']:
+            lines.append('      <system-out>%s</system-out>' % _saxutils.escape(case['stdout']))
+        if case['stderr']:
+            lines.append('      <system-err>%s</system-err>' % _saxutils.escape(case['stderr']))
+        lines.append('    </testcase>')
+    lines.append('  </testsuite>')
+    lines.append('</testsuites>')
+    with open(path, 'w') as f:
+        f.write('\n'.join(lines))
+
+
+_test_module_name = '{{.EntryPoint}}'
+_test_suite = unittest.defaultTestLoader.loadTestsFromName(_test_module_name)
+if _test_suite.countTestCases() == 0:
+    sys.stderr.write('Error: no tests were collected from %s\n' % _test_module_name)
+    sys.exit(1)
+_test_result = _JUnitTestResult()
+_test_result.buffer = True
+_test_result.startTestRun()
+_test_start = _time.time()
+_test_suite.run(_test_result)
+_test_elapsed = _time.time() - _test_start
+_test_result.stopTestRun()
+
+_test_output_path = os.environ.get('{{.TestOutputEnv}}')
+if _test_output_path:
+    _write_junit_xml(_test_output_path, _test_module_name, _test_result.test_cases, _test_elapsed)
+
+if not _test_result.wasSuccessful():
+    sys.exit(1)
+sys.exit(0)
+{{else if or .ScriptPath .Interpreter }}
 {{if .Interpreter }}
 if len(sys.argv) == 1:
     import code
@@ -596,7 +1716,12 @@ ast = compile(script_data, script_path, 'exec', flags=0, dont_inherit=1)
 # execute the script with a clean state (no imports or variables)
 exec(ast, clean_globals)
 {{else}}
+{{if .EntryPointFunc}}
+import importlib
+getattr(importlib.import_module('{{.EntryPointModule}}'), '{{.EntryPointFunc}}')()
+{{else}}
 import runpy
-runpy.run_module('{{.EntryPoint}}', run_name='__main__')
+runpy.run_module('{{.EntryPointModule}}', run_name='__main__')
+{{end}}
 {{end}}
 `
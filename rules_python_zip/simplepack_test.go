@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseEntryPointsINI(t *testing.T) {
+	input := `[console_scripts]
+foo = mypkg.cli:main
+bar=mypkg.other:run
+; a comment
+# another comment
+
+[not_console_scripts]
+baz = mypkg.other:ignored
+`
+	scripts, err := parseEntryPointsINI(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseEntryPointsINI: %s", err)
+	}
+	want := map[string]string{
+		"foo": "mypkg.cli:main",
+		"bar": "mypkg.other:run",
+	}
+	if len(scripts) != len(want) {
+		t.Fatalf("got %v, want %v", scripts, want)
+	}
+	for name, target := range want {
+		if scripts[name] != target {
+			t.Errorf("scripts[%q] = %q, want %q", name, scripts[name], target)
+		}
+	}
+}
+
+func TestParseEntryPointsININoSection(t *testing.T) {
+	scripts, err := parseEntryPointsINI(strings.NewReader("[other]\nfoo = bar:baz\n"))
+	if err != nil {
+		t.Fatalf("parseEntryPointsINI: %s", err)
+	}
+	if len(scripts) != 0 {
+		t.Errorf("got %v, want empty", scripts)
+	}
+}
+
+func TestDetectSdistTopLevelDir(t *testing.T) {
+	tests := []struct {
+		name        string
+		names       []string
+		archivePath string
+		want        string
+	}{
+		{
+			name:        "matching sdist wrapper dir is stripped",
+			names:       []string{"mypkg-1.2.3/PKG-INFO", "mypkg-1.2.3/mypkg/__init__.py"},
+			archivePath: "mypkg-1.2.3.tar.gz",
+			want:        "mypkg-1.2.3/",
+		},
+		{
+			name:        "plain tarball whose sole top dir isn't the archive's stem is left alone",
+			names:       []string{"mypkg/__init__.py", "mypkg/mod.py"},
+			archivePath: "pkg.tar.gz",
+			want:        "",
+		},
+		{
+			name:        "no shared top-level dir",
+			names:       []string{"a.py", "b.py"},
+			archivePath: "mypkg-1.2.3.tar.gz",
+			want:        "",
+		},
+		{
+			name:        "no entries",
+			names:       nil,
+			archivePath: "mypkg-1.2.3.tar.gz",
+			want:        "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectSdistTopLevelDir(tt.names, tt.archivePath)
+			if got != tt.want {
+				t.Errorf("detectSdistTopLevelDir(%v, %q) = %q, want %q", tt.names, tt.archivePath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSdistStem(t *testing.T) {
+	tests := map[string]string{
+		"mypkg-1.2.3.tar.gz":           "mypkg-1.2.3",
+		"mypkg-1.2.3.tgz":              "mypkg-1.2.3",
+		"mypkg-1.2.3.tar":              "mypkg-1.2.3",
+		"/path/to/mypkg-1.2.3.tar.bz2": "mypkg-1.2.3",
+	}
+	for archivePath, want := range tests {
+		if got := sdistStem(archivePath); got != want {
+			t.Errorf("sdistStem(%q) = %q, want %q", archivePath, got, want)
+		}
+	}
+}
+
+func TestCompressionConfigResolve(t *testing.T) {
+	config := compressionConfig{
+		Default: zip.Deflate,
+		Overrides: []compressionRule{
+			{Glob: "*.so", Method: zip.Store},
+			{Glob: "data/*.bin", Method: zip.Store},
+		},
+	}
+	tests := map[string]uint16{
+		"pkg/mod.py":        zip.Deflate,
+		"pkg/libfoo.so":     zip.Store,
+		"pkg/sub/libfoo.so": zip.Store,
+		"data/weights.bin":  zip.Store,
+		"other/weights.bin": zip.Deflate,
+	}
+	for name, want := range tests {
+		if got := config.resolve(name); got != want {
+			t.Errorf("resolve(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestCompressionOverrideMethodFromString(t *testing.T) {
+	if _, err := compressionOverrideMethodFromString("deflate-max"); err == nil {
+		t.Error(`compressionOverrideMethodFromString("deflate-max") = nil error, want error`)
+	}
+	method, err := compressionOverrideMethodFromString("deflate")
+	if err != nil || method != zip.Deflate {
+		t.Errorf(`compressionOverrideMethodFromString("deflate") = (%d, %v), want (%d, nil)`, method, err, zip.Deflate)
+	}
+}
+
+func TestResolveNeeded(t *testing.T) {
+	byBasenameAndDir := map[string]map[string]string{
+		"libopenblas.so": {
+			"pkgA":     "pkgA/libopenblas.so",
+			"pkgB/lib": "pkgB/lib/libopenblas.so",
+		},
+	}
+	tests := []struct {
+		name          string
+		reachableDirs []string
+		want          []string
+	}{
+		{
+			name:          "matches only the reachable directory",
+			reachableDirs: []string{"pkgA"},
+			want:          []string{"pkgA/libopenblas.so"},
+		},
+		{
+			name:          "a same-named lib in an unrelated package isn't reachable",
+			reachableDirs: []string{"pkgC"},
+			want:          nil,
+		},
+		{
+			name:          "an rpath directory is reachable alongside the lib's own dir",
+			reachableDirs: []string{"pkgC", "pkgB/lib"},
+			want:          []string{"pkgB/lib/libopenblas.so"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveNeeded("libopenblas.so", tt.reachableDirs, byBasenameAndDir)
+			if len(got) != len(tt.want) {
+				t.Fatalf("resolveNeeded(...) = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("resolveNeeded(...) = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestScanNativeDependenciesSkipsUnparseableData(t *testing.T) {
+	allPaths := []string{"pkg/libfoo.so"}
+	nativeLibData := map[string][]byte{"pkg/libfoo.so": []byte("not an ELF or Mach-O file")}
+	closure, searchDirs := scanNativeDependencies(allPaths, nativeLibData)
+	if !closure["pkg/libfoo.so"] {
+		t.Errorf("closure = %v, want pkg/libfoo.so present even though it couldn't be parsed", closure)
+	}
+	if len(searchDirs) != 0 {
+		t.Errorf("searchDirs = %v, want empty", searchDirs)
+	}
+}
+
+func TestIsLikelySystemLibrary(t *testing.T) {
+	tests := map[string]bool{
+		"libc.so.6":            true,
+		"libpthread.so.0":      true,
+		"ld-linux-x86-64.so.2": true,
+		"libSystem.B.dylib":    true,
+		"libopenblas.so":       false,
+		"libfoo.so.1":          false,
+	}
+	for base, want := range tests {
+		if got := isLikelySystemLibrary(base); got != want {
+			t.Errorf("isLikelySystemLibrary(%q) = %v, want %v", base, got, want)
+		}
+	}
+}
+
+func TestParsePreludePoint(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    preludePoint
+		wantErr bool
+	}{
+		{ref: "mypkg.tracing_init", want: preludePoint{Module: "mypkg.tracing_init"}},
+		{ref: "mypkg.monkeypatch:init", want: preludePoint{Module: "mypkg.monkeypatch", Func: "init"}},
+		{ref: "_private.mod:_func", want: preludePoint{Module: "_private.mod", Func: "_func"}},
+		{ref: "", wantErr: true},
+		{ref: "1mypkg.mod", wantErr: true},
+		{ref: "mypkg.mod:", wantErr: true},
+		{ref: "mypkg.mod:func:extra", wantErr: true},
+		{ref: "mypkg..mod", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parsePreludePoint(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePreludePoint(%q) = %v, nil, want error", tt.ref, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePreludePoint(%q): %s", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("parsePreludePoint(%q) = %+v, want %+v", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMainTemplateTestModeZeroTestsFail(t *testing.T) {
+	var buf bytes.Buffer
+	args := &mainArgs{
+		TestMode:      true,
+		TestOutputEnv: "XML_OUTPUT_FILE",
+		EntryPoint:    "mypkg.tests",
+	}
+	if err := mainTemplate.Execute(&buf, args); err != nil {
+		t.Fatalf("mainTemplate.Execute: %s", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "_test_module_name = 'mypkg.tests'") {
+		t.Errorf("generated script doesn't set _test_module_name from EntryPoint:\n%s", out)
+	}
+	if !strings.Contains(out, "_test_suite.countTestCases() == 0") {
+		t.Errorf("generated script doesn't guard against zero collected tests:\n%s", out)
+	}
+	if !strings.Contains(out, "wasSuccessful()") {
+		t.Errorf("generated script doesn't check the test result:\n%s", out)
+	}
+}